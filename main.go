@@ -14,23 +14,42 @@
 package main
 
 import (
+	"container/list"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/mwitkow/go-conntrack"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/api/books/v1"
+	"google.golang.org/api/googleapi"
 )
 
 var (
@@ -41,15 +60,36 @@ var (
 	gen                    *rand.Rand
 	store                  responseCache
 
-	incomingHeaders = []string{
-		"x-request-id",
-		"x-b3-traceid",
-		"x-b3-spanid",
-		"x-b3-parentspanid",
-		"x-b3-sampled",
-		"x-b3-flags",
-		"x-ot-span-context",
-	}
+	googleAPIKey          string
+	googleCredentialsFile string
+	googleClient          *http.Client
+
+	cacheBackend    string
+	cacheURL        string
+	cacheMaxEntries int
+
+	cbFailureRatio float64
+	cbMinRequests  int
+	cbWindow       time.Duration
+	cbOpenDuration time.Duration
+	cb             *circuitBreaker
+
+	retryMaxAttempts int
+	retryBaseDelay   time.Duration
+
+	otlpEndpoint string
+	tracer       = otel.Tracer("bookinfo-details")
+
+	shutdownTimeout   time.Duration
+	cacheSnapshotPath string
+	ready             int32
+
+	maxConcurrentDownstream int
+	downstreamSem           chan struct{}
+	sfGroup                 singleflight.Group
+
+	errNotFound            = errors.New("not found")
+	errDownstreamSaturated = errors.New("downstream concurrency limit reached")
 )
 
 var (
@@ -67,7 +107,7 @@ var (
 			Help:    "Histogram of request latencies to the downstream API.",
 			Buckets: []float64{.1, .5, 1, 1.5, 2, 5},
 		},
-		[]string{"code"},
+		[]string{"code", "auth"},
 	)
 	inflightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "details_incoming_requests_in_flight",
@@ -76,12 +116,47 @@ var (
 	cacheSize = prometheus.NewGaugeFunc(
 		prometheus.GaugeOpts{
 			Name: "details_cache_size",
-			Help: "Number of items in the in-memory cache",
+			Help: "Number of items in the cache",
 		},
 		func() float64 {
 			return float64(store.length())
 		},
 	)
+	cacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "details_cache_hits_total",
+		Help: "Total number of cache lookups that found a cached entry.",
+	})
+	cacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "details_cache_misses_total",
+		Help: "Total number of cache lookups that found no cached entry.",
+	})
+	cacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "details_cache_evictions_total",
+		Help: "Total number of cache entries evicted, either because they expired or the cache was full.",
+	})
+	cacheErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "details_cache_errors_total",
+		Help: "Total number of cache backend errors (e.g. Redis unavailable), distinct from ordinary misses.",
+	})
+	circuitState = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "details_circuit_state",
+		Help: "State of the circuit breaker protecting the downstream API: 0=closed, 1=open, 2=half-open.",
+	})
+	outgoingRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "details_outgoing_retries_total",
+			Help: "Total number of retried downstream calls, by final outcome.",
+		},
+		[]string{"outcome"},
+	)
+	downstreamCoalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "details_downstream_coalesced_total",
+		Help: "Total number of requests that shared an in-flight downstream call instead of issuing a new one.",
+	})
+	downstreamRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "details_downstream_rejected_total",
+		Help: "Total number of requests rejected because the downstream concurrency limit was reached.",
+	})
 )
 
 func init() {
@@ -91,15 +166,38 @@ func init() {
 	flag.DurationVar(&delay, "delay", 0*time.Second, "Artifical delay to wait after receiving the response from the downstream API")
 	flag.DurationVar(&expiry, "cache-expiry", 0*time.Second, "How long to keep objects in the cache")
 	flag.Float64Var(&errorRatio, "error", 0.0, "Ratio of injected error responses")
+	flag.StringVar(&googleAPIKey, "google-api-key", os.Getenv("GOOGLE_API_KEY"), "API key used to authenticate against the Google Books API (overrides -google-credentials-file)")
+	flag.StringVar(&googleCredentialsFile, "google-credentials-file", os.Getenv("GOOGLE_CREDENTIALS_FILE"), "Path to a service account JSON file used to authenticate against the Google Books API")
+	flag.StringVar(&cacheBackend, "cache-backend", "memory", "Cache backend to use: \"memory\" for an in-process LRU or \"redis\"")
+	flag.StringVar(&cacheURL, "cache-url", "", "Redis URL (e.g. redis://host:6379/0), required when -cache-backend=redis")
+	flag.IntVar(&cacheMaxEntries, "cache-max-entries", 10000, "Maximum number of entries kept by the in-process LRU cache (memory backend only, <=0 means unbounded)")
+	flag.Float64Var(&cbFailureRatio, "cb-failure-ratio", 0.5, "Ratio of failed downstream calls in the current window at or above which the circuit breaker trips open")
+	flag.IntVar(&cbMinRequests, "cb-min-requests", 20, "Minimum number of downstream calls in the current window before the circuit breaker can trip")
+	flag.DurationVar(&cbWindow, "cb-window", 30*time.Second, "Length of the fixed window over which downstream failures are counted; counts reset once it elapses (not a sliding window)")
+	flag.DurationVar(&cbOpenDuration, "cb-open-duration", 10*time.Second, "How long the circuit breaker stays open before allowing a single probe request")
+	flag.IntVar(&retryMaxAttempts, "retry-max-attempts", 3, "Maximum number of attempts (including the first) for a downstream call")
+	flag.DurationVar(&retryBaseDelay, "retry-base-delay", 100*time.Millisecond, "Base delay for exponential backoff with full jitter between retries")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "OTLP/gRPC collector endpoint to export traces to (e.g. otel-collector:4317), traces are discarded when unset")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "Maximum duration to wait for in-flight requests to drain on shutdown")
+	flag.StringVar(&cacheSnapshotPath, "cache-snapshot-path", "", "Path to dump the in-process LRU cache to on shutdown and reload it from on startup (memory backend only)")
+	flag.IntVar(&maxConcurrentDownstream, "max-concurrent-downstream", 50, "Maximum number of concurrent calls to the downstream Google Books API")
 	if errorRatio < 0.0 {
 		errorRatio = 0.0
 	}
 	if errorRatio > 1.0 {
 		errorRatio = 1.0
 	}
+	if retryMaxAttempts < 1 {
+		retryMaxAttempts = 1
+	}
 	gen = rand.New(rand.NewSource(time.Now().UnixNano()))
 
-	prometheus.MustRegister(incomingDuration, outgoingDuration, inflightRequests)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		b3.New(),
+		propagation.TraceContext{},
+	))
+
+	prometheus.MustRegister(incomingDuration, outgoingDuration, inflightRequests, cacheSize, cacheHits, cacheMisses, cacheEvictions, cacheErrors, circuitState, outgoingRetries, downstreamCoalesced, downstreamRejected)
 	for _, c := range []int{http.StatusOK, http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError, http.StatusServiceUnavailable} {
 		incomingDuration.WithLabelValues(fmt.Sprintf("%d", c))
 	}
@@ -137,36 +235,50 @@ func (c *noopCache) get(int) *detailsResponse { return nil }
 func (c *noopCache) set(*detailsResponse)     {}
 func (c *noopCache) length() int              { return 0 }
 
+// cache is an in-process, size-bounded LRU cache. Entries are held in a
+// doubly-linked list ordered by recency of use so that get/set/evict are
+// all O(1); entries also carry a TTL which is checked lazily on get and
+// swept periodically by a janitor goroutine.
 type cache struct {
-	expiry  time.Duration
+	expiry     time.Duration
+	maxEntries int
+
 	mtx     sync.Mutex
-	entries map[int]*cacheEntry
+	entries map[int]*list.Element
+	order   *list.List
 }
 
 type cacheEntry struct {
+	id       int
 	response *detailsResponse
 	ttl      time.Time
 }
 
-func newCache(expiry time.Duration) *cache {
+// newCache creates an LRU cache that keeps objects for expiry and holds at
+// most maxEntries of them. maxEntries <= 0 means unbounded.
+func newCache(expiry time.Duration, maxEntries int) *cache {
 	c := &cache{
-		mtx:     sync.Mutex{},
-		entries: make(map[int]*cacheEntry),
-		expiry:  expiry,
+		expiry:     expiry,
+		maxEntries: maxEntries,
+		entries:    make(map[int]*list.Element),
+		order:      list.New(),
 	}
 	go func() {
-		for {
-			select {
-			case <-time.After(1 * time.Second):
-				c.mtx.Lock()
-				now := time.Now()
-				for k := range c.entries {
-					if c.entries[k].ttl.Before(now) {
-						delete(c.entries, k)
-					}
+		for range time.Tick(1 * time.Second) {
+			c.mtx.Lock()
+			now := time.Now()
+			// order is recency, not expiry, so a TTL sweep still has to
+			// walk every entry; it only bounds set/evict-on-insert to O(1).
+			for e := c.order.Back(); e != nil; {
+				prev := e.Prev()
+				entry := e.Value.(*cacheEntry)
+				if entry.ttl.Before(now) {
+					c.removeElement(e)
+					cacheEvictions.Inc()
 				}
-				c.mtx.Unlock()
+				e = prev
 			}
+			c.mtx.Unlock()
 		}
 	}()
 	return c
@@ -177,27 +289,393 @@ func (c *cache) get(id int) *detailsResponse {
 	defer c.mtx.Unlock()
 	e, ok := c.entries[id]
 	if !ok {
+		cacheMisses.Inc()
 		return nil
 	}
-	if time.Now().After(e.ttl) {
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.ttl) {
+		c.removeElement(e)
+		cacheEvictions.Inc()
+		cacheMisses.Inc()
 		return nil
 	}
-	return e.response
+	c.order.MoveToFront(e)
+	cacheHits.Inc()
+	return entry.response
 }
 
 func (c *cache) set(d *detailsResponse) {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
-	c.entries[d.ID] = &cacheEntry{
+	if e, ok := c.entries[d.ID]; ok {
+		e.Value.(*cacheEntry).response = d
+		e.Value.(*cacheEntry).ttl = time.Now().Add(c.expiry)
+		c.order.MoveToFront(e)
+		return
+	}
+	e := c.order.PushFront(&cacheEntry{
+		id:       d.ID,
 		response: d,
 		ttl:      time.Now().Add(c.expiry),
+	})
+	c.entries[d.ID] = e
+	if c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		c.removeElement(c.order.Back())
+		cacheEvictions.Inc()
 	}
 }
 
 func (c *cache) length() int {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
-	return len(c.entries)
+	return c.order.Len()
+}
+
+// removeElement drops e from both the list and the index. Callers must
+// hold c.mtx.
+func (c *cache) removeElement(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*cacheEntry).id)
+}
+
+// snapshot returns the cached responses, most-recently-used first, for
+// persisting to disk.
+func (c *cache) snapshot() []*detailsResponse {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	out := make([]*detailsResponse, 0, c.order.Len())
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		out = append(out, e.Value.(*cacheEntry).response)
+	}
+	return out
+}
+
+// saveCacheSnapshot dumps the in-process LRU cache to path. It is a no-op
+// for other backends, which are either persistent (Redis) or disabled.
+func saveCacheSnapshot(path string) error {
+	lru, ok := store.(*cache)
+	if !ok {
+		return nil
+	}
+	b, err := json.Marshal(lru.snapshot())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0o644)
+}
+
+// loadCacheSnapshot reloads a snapshot written by saveCacheSnapshot into
+// the in-process LRU cache so that a restart doesn't cold-start the
+// Google Books quota. A missing file is not an error.
+func loadCacheSnapshot(path string) error {
+	lru, ok := store.(*cache)
+	if !ok {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var items []*detailsResponse
+	if err := json.Unmarshal(b, &items); err != nil {
+		return err
+	}
+	for _, d := range items {
+		lru.set(d)
+	}
+	return nil
+}
+
+// redisCache is a responseCache backed by Redis, used to share the cache
+// across multiple replicas of the service instead of keeping it in-process.
+type redisCache struct {
+	client *redis.Client
+	expiry time.Duration
+}
+
+func newRedisCache(addr string, expiry time.Duration) *redisCache {
+	opt, err := redis.ParseURL(addr)
+	if err != nil {
+		// Fall back to treating the value as a plain host:port address.
+		opt = &redis.Options{Addr: addr}
+	}
+	return &redisCache{
+		client: redis.NewClient(opt),
+		expiry: expiry,
+	}
+}
+
+func redisKey(id int) string {
+	return fmt.Sprintf("details:%d", id)
+}
+
+func (c *redisCache) get(id int) *detailsResponse {
+	b, err := c.client.Get(context.Background(), redisKey(id)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			cacheMisses.Inc()
+		} else {
+			log.Printf("redis cache get failed: %s", err)
+			cacheErrors.Inc()
+		}
+		return nil
+	}
+	var d detailsResponse
+	if err := json.Unmarshal(b, &d); err != nil {
+		log.Printf("redis cache get: failed to unmarshal cached entry: %s", err)
+		cacheErrors.Inc()
+		return nil
+	}
+	cacheHits.Inc()
+	return &d
+}
+
+func (c *redisCache) set(d *detailsResponse) {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+	c.client.Set(context.Background(), redisKey(d.ID), b, c.expiry)
+}
+
+func (c *redisCache) length() int {
+	n, err := c.client.DBSize(context.Background()).Result()
+	if err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+// authRoundTripper instruments the downstream requests and tags the
+// "auth" label of outgoingDuration with the authentication mode that is
+// in effect, so that auth-related failures stand out in Prometheus.
+type authRoundTripper struct {
+	next http.RoundTripper
+	auth string
+}
+
+func (t *authRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	code := "error"
+	if resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	outgoingDuration.WithLabelValues(code, t.auth).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// apiKeyRoundTripper injects the Google API key as a "key" query parameter
+// on every outgoing request, as required by API-key authentication.
+type apiKeyRoundTripper struct {
+	next   http.RoundTripper
+	apiKey string
+}
+
+func (t *apiKeyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	q := req.URL.Query()
+	q.Set("key", t.apiKey)
+	req.URL.RawQuery = q.Encode()
+	return t.next.RoundTrip(req)
+}
+
+// newGoogleClient builds the *http.Client used to talk to the Google Books
+// API, wired up with whichever authentication mode is configured. It is
+// constructed once at startup and reused across requests rather than
+// rebuilt on every call.
+func newGoogleClient(ctx context.Context) (*http.Client, error) {
+	base := otelhttp.NewTransport(&http.Transport{
+		IdleConnTimeout: 1 * time.Minute,
+		DialContext: conntrack.NewDialContextFunc(
+			conntrack.DialWithTracing(),
+			conntrack.DialWithName("google-api"),
+		),
+	})
+
+	var (
+		rt   http.RoundTripper = base
+		auth                   = "none"
+	)
+	switch {
+	case googleAPIKey != "":
+		rt = &apiKeyRoundTripper{next: base, apiKey: googleAPIKey}
+		auth = "api_key"
+	case googleCredentialsFile != "":
+		data, err := ioutil.ReadFile(googleCredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read google credentials file: %s", err)
+		}
+		creds, err := google.CredentialsFromJSON(ctx, data, books.BooksScope)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse google credentials file: %s", err)
+		}
+		rt = &oauth2.Transport{Source: creds.TokenSource, Base: base}
+		auth = "credentials"
+	default:
+		if creds, err := google.FindDefaultCredentials(ctx, books.BooksScope); err == nil {
+			rt = &oauth2.Transport{Source: creds.TokenSource, Base: base}
+			auth = "credentials"
+		}
+	}
+
+	return &http.Client{Transport: &authRoundTripper{next: rt, auth: auth}}, nil
+}
+
+// circuitBreakerState mirrors the classic three-state circuit breaker state
+// machine, guarding the downstream Google Books call.
+type circuitBreakerState int
+
+const (
+	circuitClosed circuitBreakerState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker trips to open once at least minRequests calls have been
+// observed in the current window and the failure ratio among them reaches
+// failureRatio. Once open, it stays open for openDuration before letting a
+// single probe request through in half-open state.
+type circuitBreaker struct {
+	failureRatio float64
+	minRequests  int
+	window       time.Duration
+	openDuration time.Duration
+
+	mtx           sync.Mutex
+	state         circuitBreakerState
+	windowStart   time.Time
+	requests      int
+	failures      int
+	openedAt      time.Time
+	probeInFlight bool
+}
+
+func newCircuitBreaker(failureRatio float64, minRequests int, window, openDuration time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		failureRatio: failureRatio,
+		minRequests:  minRequests,
+		window:       window,
+		openDuration: openDuration,
+		windowStart:  time.Now(),
+	}
+}
+
+// allow reports whether a call may proceed. When it returns true for a
+// circuit currently half-open, the caller is the single probe and must
+// report its outcome via recordResult.
+func (cb *circuitBreaker) allow() bool {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		if time.Since(cb.openedAt) < cb.openDuration {
+			return false
+		}
+		cb.state = circuitHalfOpen
+		cb.probeInFlight = true
+		circuitState.Set(float64(circuitHalfOpen))
+		return true
+	case circuitHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+func (cb *circuitBreaker) recordResult(success bool) {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	if cb.state == circuitHalfOpen {
+		cb.probeInFlight = false
+		if success {
+			cb.state = circuitClosed
+			cb.requests, cb.failures = 0, 0
+			cb.windowStart = time.Now()
+			circuitState.Set(float64(circuitClosed))
+		} else {
+			cb.state = circuitOpen
+			cb.openedAt = time.Now()
+			circuitState.Set(float64(circuitOpen))
+		}
+		return
+	}
+
+	if time.Since(cb.windowStart) > cb.window {
+		cb.requests, cb.failures = 0, 0
+		cb.windowStart = time.Now()
+	}
+	cb.requests++
+	if !success {
+		cb.failures++
+	}
+	if cb.requests >= cb.minRequests && float64(cb.failures)/float64(cb.requests) >= cb.failureRatio {
+		cb.state = circuitOpen
+		cb.openedAt = time.Now()
+		circuitState.Set(float64(circuitOpen))
+	}
+}
+
+// fullJitterBackoff returns a random delay in [0, base*2^attempt), the
+// "full jitter" strategy, to avoid retry storms after a shared outage. It
+// uses the package-level rand functions (safe for concurrent use) rather
+// than the unsynchronized gen, since retries across concurrent in-flight
+// requests call this from multiple goroutines.
+func fullJitterBackoff(base time.Duration, attempt int) time.Duration {
+	ceiling := base * time.Duration(1<<uint(attempt))
+	if ceiling <= 0 {
+		return base
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// callVolumes runs volCall.Do() behind the circuit breaker, retrying
+// transient failures with bounded exponential backoff and full jitter. The
+// total time spent never exceeds ctx's deadline.
+var errCircuitOpen = fmt.Errorf("circuit breaker open")
+
+func callVolumes(ctx context.Context, volCall *books.VolumesListCall) (*books.Volumes, error) {
+	if !cb.allow() {
+		return nil, errCircuitOpen
+	}
+
+	var (
+		vols *books.Volumes
+		err  error
+	)
+	attempt := 0
+	for ; attempt < retryMaxAttempts; attempt++ {
+		vols, err = volCall.Do()
+		if err == nil {
+			cb.recordResult(true)
+			if attempt > 0 {
+				outgoingRetries.WithLabelValues("success").Inc()
+			}
+			return vols, nil
+		}
+		if ctx.Err() != nil || attempt == retryMaxAttempts-1 {
+			break
+		}
+		// Only 5xx API errors and transport errors (e.g. timeouts) are
+		// transient; other API errors such as 4xx are not retried.
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code < 500 {
+			break
+		}
+		select {
+		case <-time.After(fullJitterBackoff(retryBaseDelay, attempt)):
+		case <-ctx.Done():
+		}
+	}
+	cb.recordResult(false)
+	if attempt > 0 {
+		outgoingRetries.WithLabelValues("failure").Inc()
+	}
+	return nil, err
 }
 
 func writeResponseError(w http.ResponseWriter, code int, e error) {
@@ -233,11 +711,14 @@ func details(w http.ResponseWriter, r *http.Request) {
 	inflightRequests.Inc()
 	defer inflightRequests.Dec()
 
+	span := trace.SpanFromContext(r.Context())
+
 	var (
 		err  error
 		code = http.StatusOK
 	)
 	defer func() {
+		span.SetAttributes(attribute.Int("http.status_code", code))
 		if err != nil {
 			log.Printf("/details/ error: %q", err)
 			writeResponseError(w, code, err)
@@ -257,60 +738,90 @@ func details(w http.ResponseWriter, r *http.Request) {
 		// hard-code here with one of the ISBN for "The comedy of errors".
 		isbn = "0486424618"
 	}
+	span.SetAttributes(attribute.String("isbn", isbn))
 	id, err := strconv.Atoi(isbn)
 	if err != nil {
 		code = http.StatusBadRequest
 		return
 	}
 	if v := store.get(id); v != nil {
+		span.SetAttributes(attribute.Bool("cache.hit", true))
 		writeResponseOK(w, v)
 		return
 	}
+	span.SetAttributes(attribute.Bool("cache.hit", false))
+
+	// Concurrent misses for the same ISBN share a single downstream call.
+	// The call is bound to its own timeout, independent of whichever
+	// caller's request happens to be the singleflight leader, so that one
+	// caller's cancellation doesn't fail every coalesced caller.
+	v, sfErr, shared := sfGroup.Do(isbn, func() (interface{}, error) {
+		return fetchBook(r.Context(), isbn, id)
+	})
+	if shared {
+		downstreamCoalesced.Inc()
+	}
+	err = sfErr
+	if err != nil {
+		switch {
+		case errors.Is(err, errDownstreamSaturated):
+			code = http.StatusServiceUnavailable
+			w.Header().Set("Retry-After", "1")
+		case errors.Is(err, errNotFound):
+			code = http.StatusNotFound
+		case errors.Is(err, errCircuitOpen), errors.Is(err, context.DeadlineExceeded):
+			code = http.StatusServiceUnavailable
+		default:
+			code = http.StatusInternalServerError
+		}
+		return
+	}
+	book := v.(*detailsResponse)
 
-	svc, err := books.New(
-		&http.Client{
-			Transport: promhttp.InstrumentRoundTripperDuration(outgoingDuration, &http.Transport{
-				IdleConnTimeout: 1 * time.Minute,
-				DialContext: conntrack.NewDialContextFunc(
-					conntrack.DialWithTracing(),
-					conntrack.DialWithName("google-api"),
-				),
-			}),
-		},
-	)
+	<-time.After(delay)
+	writeResponseOK(w, book)
+}
+
+// fetchBook looks up isbn/id against the downstream Google Books API,
+// bounded by the global concurrency semaphore, and stores the result in
+// the cache. It is only ever invoked by the singleflight leader for a
+// given ISBN, on behalf of every caller coalesced onto that ISBN, so its
+// own timeout governs the call rather than any one caller's cancellation.
+// parentCtx is only used for its trace context, so the client span still
+// joins the leader's trace without inheriting the leader's deadline.
+func fetchBook(parentCtx context.Context, isbn string, id int) (*detailsResponse, error) {
+	select {
+	case downstreamSem <- struct{}{}:
+		defer func() { <-downstreamSem }()
+	default:
+		downstreamRejected.Inc()
+		return nil, errDownstreamSaturated
+	}
+
+	svc, err := books.New(googleClient)
 	if err != nil {
 		//TODO: implement fallback response
-		code = http.StatusInternalServerError
-		return
+		return nil, err
 	}
 
 	volService := books.NewVolumesService(svc)
 	volCall := volService.List(fmt.Sprintf("isbn:%s", isbn))
 
-	ctx := r.Context()
-	ctx, cancel := context.WithTimeout(ctx, timeout)
+	traceCtx := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(parentCtx))
+	ctx, cancel := context.WithTimeout(traceCtx, timeout)
 	defer cancel()
 	volCall = volCall.Context(ctx)
 
-	// Add tracing headers.
-	header := volCall.Header()
-	for _, h := range incomingHeaders {
-		header.Add(h, r.Header.Get(h))
-	}
-
-	// Send the request to the downstream API.
-	vols, err := volCall.Do()
+	// Send the request to the downstream API, wrapped in its own client span.
+	ctx, clientSpan := tracer.Start(ctx, "googlebooks.volumes.list", trace.WithSpanKind(trace.SpanKindClient))
+	volCall = volCall.Context(ctx)
+	vols, err := callVolumes(ctx, volCall)
+	clientSpan.End()
 	if err != nil {
-		code = http.StatusInternalServerError
-		if ctx.Err() != nil {
-			code = http.StatusServiceUnavailable
-		}
-		return
+		return nil, err
 	}
 	if len(vols.Items) == 0 {
-		err = fmt.Errorf("ISBN %s not found", isbn)
-		code = http.StatusNotFound
-		return
+		return nil, fmt.Errorf("ISBN %s not found: %w", isbn, errNotFound)
 	}
 
 	vol := vols.Items[0].VolumeInfo
@@ -334,8 +845,7 @@ func details(w http.ResponseWriter, r *http.Request) {
 	}
 	store.set(book)
 
-	<-time.After(delay)
-	writeResponseOK(w, book)
+	return book, nil
 }
 
 func main() {
@@ -346,25 +856,104 @@ func main() {
 		os.Exit(0)
 	}
 
-	if expiry > time.Duration(0) {
-		log.Printf("Using cache expiry (ttl=%v)", expiry)
-		store = newCache(expiry)
-	} else {
+	switch {
+	case cacheBackend == "redis":
+		if cacheURL == "" {
+			log.Fatal("-cache-url is required when -cache-backend=redis")
+		}
+		log.Printf("Using Redis cache (url=%s, ttl=%v)", cacheURL, expiry)
+		store = newRedisCache(cacheURL, expiry)
+	case expiry > time.Duration(0):
+		log.Printf("Using in-process LRU cache (ttl=%v, max-entries=%d)", expiry, cacheMaxEntries)
+		store = newCache(expiry, cacheMaxEntries)
+	default:
 		store = &noopCache{}
 	}
+	if cacheSnapshotPath != "" {
+		if err := loadCacheSnapshot(cacheSnapshotPath); err != nil {
+			log.Printf("failed to load cache snapshot from %s: %s", cacheSnapshotPath, err)
+		}
+	}
+
+	var err error
+	googleClient, err = newGoogleClient(context.Background())
+	if err != nil {
+		log.Fatalf("failed to initialize the Google Books client: %s", err)
+	}
+	cb = newCircuitBreaker(cbFailureRatio, cbMinRequests, cbWindow, cbOpenDuration)
+	downstreamSem = make(chan struct{}, maxConcurrentDownstream)
+
+	shutdownTracing, err := initTracing(context.Background(), otlpEndpoint)
+	if err != nil {
+		log.Fatalf("failed to initialize tracing: %s", err)
+	}
+	defer shutdownTracing(context.Background())
 
 	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
 		writeResponseOK(w, &statusResponse{Message: "OK"})
 	})
+	http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&ready) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writeResponseOK(w, &statusResponse{Message: "OK"})
+	})
 
 	http.HandleFunc("/metrics", promhttp.Handler().ServeHTTP)
 	http.Handle("/details/", promhttp.InstrumentHandlerInFlight(
 		inflightRequests,
 		promhttp.InstrumentHandlerDuration(incomingDuration,
-			http.HandlerFunc(details),
+			otelhttp.NewHandler(http.HandlerFunc(details), "details"),
 		),
 	))
 
-	log.Println("Listening on", listen)
-	log.Fatal(http.ListenAndServe(listen, nil))
+	server := &http.Server{Addr: listen}
+	go func() {
+		log.Println("Listening on", listen)
+		atomic.StoreInt32(&ready, 1)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("listen: %s", err)
+		}
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	log.Printf("Received %s, shutting down", sig)
+
+	// Flip /ready first so the load balancer stops sending new traffic
+	// before we start draining in-flight requests.
+	atomic.StoreInt32(&ready, 0)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("graceful shutdown did not complete: %s", err)
+	}
+
+	// Snapshot only after in-flight requests have drained, so results they
+	// wrote to the cache are captured rather than lost.
+	if cacheSnapshotPath != "" {
+		if err := saveCacheSnapshot(cacheSnapshotPath); err != nil {
+			log.Printf("failed to save cache snapshot to %s: %s", cacheSnapshotPath, err)
+		}
+	}
+}
+
+// initTracing wires up the global TracerProvider. With no OTLP endpoint
+// configured it keeps the otel no-op default; otherwise it exports spans
+// over OTLP/gRPC to the given collector.
+func initTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exp, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %s", err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
 }
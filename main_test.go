@@ -0,0 +1,128 @@
+// Copyright 2019 Simon Pasquier
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheLRUEviction(t *testing.T) {
+	c := newCache(time.Minute, 2)
+
+	c.set(&detailsResponse{ID: 1})
+	c.set(&detailsResponse{ID: 2})
+	c.set(&detailsResponse{ID: 3})
+
+	if got := c.length(); got != 2 {
+		t.Fatalf("length() = %d, want 2", got)
+	}
+	if v := c.get(1); v != nil {
+		t.Fatalf("get(1) = %v, want nil (should have been evicted)", v)
+	}
+	if v := c.get(2); v == nil {
+		t.Fatal("get(2) = nil, want a cached entry")
+	}
+	if v := c.get(3); v == nil {
+		t.Fatal("get(3) = nil, want a cached entry")
+	}
+
+	// Touching 2 should make it more recently used than 3, so the next
+	// insertion evicts 3 instead.
+	c.get(2)
+	c.set(&detailsResponse{ID: 4})
+
+	if v := c.get(3); v != nil {
+		t.Fatalf("get(3) = %v, want nil (should have been evicted as least recently used)", v)
+	}
+	if v := c.get(2); v == nil {
+		t.Fatal("get(2) = nil, want a cached entry (was recently used)")
+	}
+	if v := c.get(4); v == nil {
+		t.Fatal("get(4) = nil, want a cached entry")
+	}
+}
+
+func TestCacheTTLExpiry(t *testing.T) {
+	c := newCache(10*time.Millisecond, 0)
+	c.set(&detailsResponse{ID: 1})
+
+	if v := c.get(1); v == nil {
+		t.Fatal("get(1) = nil, want a cached entry before expiry")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if v := c.get(1); v != nil {
+		t.Fatalf("get(1) = %v, want nil after expiry", v)
+	}
+}
+
+func TestCircuitBreakerTripsOpen(t *testing.T) {
+	cb := newCircuitBreaker(0.5, 4, time.Minute, 20*time.Millisecond)
+
+	if !cb.allow() {
+		t.Fatal("allow() = false, want true for a fresh closed breaker")
+	}
+
+	for i := 0; i < 4; i++ {
+		cb.recordResult(false)
+	}
+
+	if cb.allow() {
+		t.Fatal("allow() = true, want false once the failure ratio trips the breaker open")
+	}
+}
+
+func TestCircuitBreakerHalfOpenRecovers(t *testing.T) {
+	cb := newCircuitBreaker(0.5, 4, time.Minute, 20*time.Millisecond)
+	for i := 0; i < 4; i++ {
+		cb.recordResult(false)
+	}
+	if cb.allow() {
+		t.Fatal("allow() = true, want false immediately after tripping open")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if !cb.allow() {
+		t.Fatal("allow() = false, want true for the half-open probe once openDuration has elapsed")
+	}
+	if cb.allow() {
+		t.Fatal("allow() = true, want false for a second concurrent caller while a probe is in flight")
+	}
+
+	cb.recordResult(true)
+
+	if !cb.allow() {
+		t.Fatal("allow() = false, want true once the probe succeeds and the breaker closes")
+	}
+}
+
+func TestCircuitBreakerHalfOpenReopensOnFailure(t *testing.T) {
+	cb := newCircuitBreaker(0.5, 4, time.Minute, 20*time.Millisecond)
+	for i := 0; i < 4; i++ {
+		cb.recordResult(false)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	if !cb.allow() {
+		t.Fatal("allow() = false, want true for the half-open probe once openDuration has elapsed")
+	}
+	cb.recordResult(false)
+
+	if cb.allow() {
+		t.Fatal("allow() = true, want false: a failed probe should reopen the breaker")
+	}
+}